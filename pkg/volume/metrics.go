@@ -0,0 +1,153 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	pvBytesUsed = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "nfs_provisioner_pv_bytes_used",
+		Help: "Current bytes used by a provisioned PV, as reported by its project quota.",
+	}, []string{"namespace", "name"})
+
+	pvBytesLimit = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "nfs_provisioner_pv_bytes_limit",
+		Help: "Hard byte limit of a provisioned PV's project quota.",
+	}, []string{"namespace", "name"})
+
+	pvInodesUsed = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "nfs_provisioner_pv_inodes_used",
+		Help: "Current inodes used by a provisioned PV, as reported by its project quota.",
+	}, []string{"namespace", "name"})
+
+	pvInodesLimit = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "nfs_provisioner_pv_inodes_limit",
+		Help: "Hard inode limit of a provisioned PV's project quota.",
+	}, []string{"namespace", "name"})
+
+	quotaExceededTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "nfs_provisioner_pv_quota_exceeded_total",
+		Help: "Number of times a provisioned PV was observed at or over its quota limit.",
+	}, []string{"namespace", "name"})
+)
+
+func init() {
+	prometheus.MustRegister(pvBytesUsed, pvBytesLimit, pvInodesUsed, pvInodesLimit, quotaExceededTotal)
+}
+
+// pvProject associates a project id with the PVC namespace/name it backs, so
+// usage can be scraped and reported with the right Prometheus labels.
+type pvProject struct {
+	projectId uint32
+	namespace string
+	name      string
+}
+
+// UsageScraper periodically polls a quotaer for every known project's usage
+// and publishes it as the nfs_provisioner_pv_* Prometheus gauges above. The
+// provisioner calls Track/Untrack as PVs are created and deleted, and runs
+// Run in a background goroutine.
+type UsageScraper struct {
+	quotaer  quotaer
+	interval time.Duration
+
+	mutex    sync.Mutex
+	projects map[uint32]pvProject
+}
+
+// NewUsageScraper builds a scraper that polls q for every tracked project's
+// usage once per interval.
+func NewUsageScraper(q quotaer, interval time.Duration) *UsageScraper {
+	return &UsageScraper{
+		quotaer:  q,
+		interval: interval,
+		projects: map[uint32]pvProject{},
+	}
+}
+
+// Track registers projectId, backing the PVC named namespace/name, to be
+// scraped for usage on every tick.
+func (s *UsageScraper) Track(projectId uint32, namespace, name string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.projects[projectId] = pvProject{projectId: projectId, namespace: namespace, name: name}
+}
+
+// Untrack stops scraping projectId and clears its published usage gauges. Its
+// nfs_provisioner_pv_quota_exceeded_total series is not deleted.
+func (s *UsageScraper) Untrack(projectId uint32) {
+	s.mutex.Lock()
+	p, ok := s.projects[projectId]
+	delete(s.projects, projectId)
+	s.mutex.Unlock()
+
+	if !ok {
+		return
+	}
+	pvBytesUsed.DeleteLabelValues(p.namespace, p.name)
+	pvBytesLimit.DeleteLabelValues(p.namespace, p.name)
+	pvInodesUsed.DeleteLabelValues(p.namespace, p.name)
+	pvInodesLimit.DeleteLabelValues(p.namespace, p.name)
+}
+
+// Run scrapes every tracked project's usage on s.interval until stop is
+// closed. It is meant to be run in its own goroutine.
+func (s *UsageScraper) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.scrapeOnce()
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (s *UsageScraper) scrapeOnce() {
+	s.mutex.Lock()
+	projects := make([]pvProject, 0, len(s.projects))
+	for _, p := range s.projects {
+		projects = append(projects, p)
+	}
+	s.mutex.Unlock()
+
+	for _, p := range projects {
+		blocksUsed, blocksHard, inodesUsed, inodesHard, err := s.quotaer.GetUsage(p.projectId)
+		if err != nil {
+			glog.Errorf("error scraping usage for project %d (%s/%s): %v", p.projectId, p.namespace, p.name, err)
+			continue
+		}
+
+		pvBytesUsed.WithLabelValues(p.namespace, p.name).Set(float64(blocksUsed))
+		pvBytesLimit.WithLabelValues(p.namespace, p.name).Set(float64(blocksHard))
+		pvInodesUsed.WithLabelValues(p.namespace, p.name).Set(float64(inodesUsed))
+		pvInodesLimit.WithLabelValues(p.namespace, p.name).Set(float64(inodesHard))
+
+		if (blocksHard > 0 && blocksUsed >= blocksHard) || (inodesHard > 0 && inodesUsed >= inodesHard) {
+			quotaExceededTotal.WithLabelValues(p.namespace, p.name).Inc()
+		}
+	}
+}
@@ -0,0 +1,401 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// reservedProjectIds is the size of the low range of project ids (starting
+// at 0) that the allocator never hands out, leaving it free for admins to
+// assign project ids of their own outside the provisioner.
+const reservedProjectIds = 1000
+
+// projectRecord is the on-disk representation of one project: which
+// directory its quota applies to and the limits applied to it. It is stored
+// as projects.d/<projectId>.json.
+type projectRecord struct {
+	ProjectId uint32    `json:"projectId"`
+	Directory string    `json:"directory"`
+	Spec      QuotaSpec `json:"spec"`
+}
+
+// usageChecker reports a project id's kernel-side quota state. It is
+// satisfied by quotaer backends via GetUsage, and lets the allocator confirm
+// a reclaimed id is truly safe to reuse before handing it out again.
+type usageChecker interface {
+	GetUsage(projectId uint32) (blocksUsed, blocksHard, inodesUsed, inodesHard uint64, err error)
+}
+
+// projectStore is a journaled, crash-safe replacement for the old plain-text
+// projects file that was mutated by appending/removing substrings under a
+// mutex. A crash between AddProject's steps used to leave stale blocks
+// behind, and removing a project by naive string replace could match the wrong
+// content when one directory's path was a prefix of another's. Here, each
+// project is one file under projects.d/, written atomically via
+// temp-file + rename + fsync, so a single project's state is always
+// internally consistent. A "projects" aggregate file mirroring the old flat
+// format is regenerated from projects.d/ after every change, for
+// backwards-compat tooling that still expects it. It also owns project id
+// allocation: see allocate and release.
+type projectStore struct {
+	dir           string // <basePath>/projects.d
+	aggregateFile string // <basePath>/projects
+	nextIdFile    string // <basePath>/next_projid
+
+	mapMutex   *sync.Mutex
+	projectIds map[uint32]bool
+
+	// freeList holds reclaimed ids, most recently released last. They are
+	// only handed back out once idIsFree confirms the kernel has forgotten
+	// them entirely; ids that fail that check are dropped rather than
+	// retried, since a still-live id won't free itself.
+	freeList []uint32
+
+	// backend confirms whether a freeList entry is truly safe to reuse. It
+	// is nil until the quotaer embedding this store finishes constructing
+	// itself and wires itself in, so ids are never recycled before that.
+	backend usageChecker
+
+	fileMutex *sync.Mutex
+}
+
+// newProjectStore opens (creating if necessary) the projects.d store rooted
+// at basePath and rebuilds the projectIds map from it. It does not garbage-
+// collect records whose directory no longer exists: that requires clearing
+// the kernel-side quota too, which needs a backend, and backend isn't wired
+// up until after the owning quotaer finishes constructing itself. Each
+// quotaer's restoreQuotas does that GC once it's safe to.
+func newProjectStore(basePath string) (*projectStore, error) {
+	dir := path.Join(basePath, "projects.d")
+	_, statErr := os.Stat(dir)
+	firstRun := os.IsNotExist(statErr)
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("error creating projects store %s: %v", dir, err)
+	}
+
+	s := &projectStore{
+		dir:           dir,
+		aggregateFile: path.Join(basePath, "projects"),
+		nextIdFile:    path.Join(basePath, "next_projid"),
+		mapMutex:      &sync.Mutex{},
+		projectIds:    map[uint32]bool{},
+		fileMutex:     &sync.Mutex{},
+	}
+
+	if firstRun {
+		if err := s.importLegacyProjectsFile(); err != nil {
+			glog.Errorf("error importing legacy projects file %s into projects store: %v", s.aggregateFile, err)
+		}
+	}
+
+	records, err := s.records()
+	if err != nil {
+		return nil, fmt.Errorf("error scanning projects store %s: %v", dir, err)
+	}
+
+	for _, r := range records {
+		s.projectIds[r.ProjectId] = true
+	}
+
+	if err := s.regenerateAggregate(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// importLegacyProjectsFile migrates an existing flat-format "projects" file
+// (from before projects.d/ existed) into the store, one record per line.
+// It's a no-op if no such file is present.
+func (s *projectStore) importLegacyProjectsFile() error {
+	data, err := ioutil.ReadFile(s.aggregateFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, match := range projectLineRe.FindAllSubmatch(data, -1) {
+		projectId, directory, spec := parseProjectLine(match)
+		if _, err := s.add(projectId, directory, spec); err != nil {
+			glog.Errorf("error importing legacy project %d (%s): %v", projectId, directory, err)
+		}
+	}
+
+	return nil
+}
+
+// records reads every projects.d/<id>.json file into a projectRecord. A
+// record that fails to parse is logged and skipped rather than failing
+// startup outright.
+func (s *projectStore) records() ([]projectRecord, error) {
+	entries, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []projectRecord
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(path.Join(s.dir, entry.Name()))
+		if err != nil {
+			glog.Errorf("error reading project record %s: %v", entry.Name(), err)
+			continue
+		}
+
+		var r projectRecord
+		if err := json.Unmarshal(data, &r); err != nil {
+			glog.Errorf("error parsing project record %s: %v", entry.Name(), err)
+			continue
+		}
+		records = append(records, r)
+	}
+
+	return records, nil
+}
+
+// recordFile is the path of projectId's record file.
+func (s *projectStore) recordFile(projectId uint32) string {
+	return path.Join(s.dir, strconv.FormatUint(uint64(projectId), 10)+".json")
+}
+
+// add persists projectId's record atomically (temp-file + rename + fsync)
+// and regenerates the aggregate file. It returns the flat-format block this
+// project occupies in the aggregate file, which AddProject hands back to its
+// caller.
+func (s *projectStore) add(projectId uint32, directory string, spec QuotaSpec) (string, error) {
+	s.fileMutex.Lock()
+	defer s.fileMutex.Unlock()
+
+	if err := s.writeRecord(projectRecord{ProjectId: projectId, Directory: directory, Spec: spec}); err != nil {
+		return "", err
+	}
+
+	if err := s.regenerateAggregateLocked(); err != nil {
+		return "", err
+	}
+
+	return formatProjectBlock(projectId, directory, spec), nil
+}
+
+// remove deletes projectId's record file and regenerates the aggregate file.
+func (s *projectStore) remove(projectId uint32) error {
+	s.fileMutex.Lock()
+	defer s.fileMutex.Unlock()
+
+	if err := os.Remove(s.recordFile(projectId)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return s.regenerateAggregateLocked()
+}
+
+// allocate returns a project id to assign to a new project: first a
+// reclaimed id from freeList that idIsFree confirms the kernel has truly
+// forgotten, otherwise the next id off the persistent next_projid counter.
+// The returned id is recorded in projectIds before allocate returns, so
+// concurrent allocations never race onto the same id.
+func (s *projectStore) allocate() (uint32, error) {
+	s.mapMutex.Lock()
+	defer s.mapMutex.Unlock()
+
+	for len(s.freeList) > 0 {
+		id := s.freeList[0]
+		s.freeList = s.freeList[1:]
+
+		if !s.idIsFree(id) {
+			glog.Warningf("not reusing project id %d: kernel still reports quota state for it", id)
+			continue
+		}
+
+		s.projectIds[id] = true
+		return id, nil
+	}
+
+	id, err := s.nextId()
+	if err != nil {
+		return 0, err
+	}
+
+	s.projectIds[id] = true
+	return id, nil
+}
+
+// release forgets projectId and adds it to freeList for possible reuse once
+// idIsFree confirms the kernel state it once held is gone.
+func (s *projectStore) release(projectId uint32) {
+	s.mapMutex.Lock()
+	defer s.mapMutex.Unlock()
+
+	delete(s.projectIds, projectId)
+	s.freeList = append(s.freeList, projectId)
+}
+
+// idIsFree reports whether the kernel has no usage and no limit left for
+// projectId, i.e. it is genuinely safe to hand back out. With no backend
+// wired up yet (during construction) it conservatively refuses reuse.
+func (s *projectStore) idIsFree(projectId uint32) bool {
+	if s.backend == nil {
+		return false
+	}
+
+	blocksUsed, blocksHard, inodesUsed, inodesHard, err := s.backend.GetUsage(projectId)
+	if err != nil {
+		return false
+	}
+
+	return blocksUsed == 0 && blocksHard == 0 && inodesUsed == 0 && inodesHard == 0
+}
+
+// nextId reads, increments and persists the next_projid counter, starting
+// it at reservedProjectIds the first time it's needed so that range stays
+// free for manually-managed projects. Callers must hold mapMutex.
+func (s *projectStore) nextId() (uint32, error) {
+	next := uint32(reservedProjectIds)
+
+	data, err := ioutil.ReadFile(s.nextIdFile)
+	if err == nil {
+		v, parseErr := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 32)
+		if parseErr != nil {
+			return 0, fmt.Errorf("error parsing %s: %v", s.nextIdFile, parseErr)
+		}
+		next = uint32(v)
+	} else if !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	if err := s.persistNextId(next + 1); err != nil {
+		return 0, err
+	}
+
+	return next, nil
+}
+
+// persistNextId atomically writes next to next_projid (temp-file + rename +
+// fsync), the same crash-safety pattern as writeRecord.
+func (s *projectStore) persistNextId(next uint32) error {
+	tmp, err := ioutil.TempFile(path.Dir(s.nextIdFile), ".next_projid-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.WriteString(strconv.FormatUint(uint64(next), 10)); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), s.nextIdFile)
+}
+
+// writeRecord atomically writes r's JSON encoding to its record file: write
+// to a temp file in the same directory, fsync it, then rename over the
+// target, so a crash mid-write can never leave a torn or half-written
+// record.
+func (s *projectStore) writeRecord(r projectRecord) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	target := s.recordFile(r.ProjectId)
+	tmp, err := ioutil.TempFile(s.dir, fmt.Sprintf(".%d-", r.ProjectId))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), target)
+}
+
+// regenerateAggregate rebuilds the "projects" aggregate file from
+// projects.d/ for backwards-compat tooling that still parses the old flat
+// format.
+func (s *projectStore) regenerateAggregate() error {
+	s.fileMutex.Lock()
+	defer s.fileMutex.Unlock()
+	return s.regenerateAggregateLocked()
+}
+
+// regenerateAggregateLocked is regenerateAggregate without acquiring
+// fileMutex; callers must already hold it.
+func (s *projectStore) regenerateAggregateLocked() error {
+	records, err := s.records()
+	if err != nil {
+		return err
+	}
+
+	var blocks string
+	for _, r := range records {
+		blocks += formatProjectBlock(r.ProjectId, r.Directory, r.Spec)
+	}
+
+	tmp, err := ioutil.TempFile(path.Dir(s.aggregateFile), ".projects-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.WriteString(blocks); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), s.aggregateFile)
+}
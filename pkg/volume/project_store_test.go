@@ -0,0 +1,116 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import "testing"
+
+// fakeUsageChecker backs idIsFree in tests without a real quotactl-capable
+// filesystem: it reports whatever usage the test wires in for a given
+// project id.
+type fakeUsageChecker struct {
+	usage map[uint32][4]uint64 // blocksUsed, blocksHard, inodesUsed, inodesHard
+}
+
+func (f *fakeUsageChecker) GetUsage(projectId uint32) (blocksUsed, blocksHard, inodesUsed, inodesHard uint64, err error) {
+	u := f.usage[projectId]
+	return u[0], u[1], u[2], u[3], nil
+}
+
+func newTestProjectStore(t *testing.T) *projectStore {
+	t.Helper()
+	s, err := newProjectStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("newProjectStore: %v", err)
+	}
+	return s
+}
+
+func TestProjectStoreAllocateStartsAboveReservedRange(t *testing.T) {
+	s := newTestProjectStore(t)
+
+	id, err := s.allocate()
+	if err != nil {
+		t.Fatalf("allocate: %v", err)
+	}
+	if id != reservedProjectIds {
+		t.Errorf("first allocated id = %d, want %d", id, reservedProjectIds)
+	}
+	if !s.projectIds[id] {
+		t.Errorf("allocated id %d not recorded in projectIds", id)
+	}
+}
+
+func TestProjectStoreReleaseWithoutBackendNeverReuses(t *testing.T) {
+	s := newTestProjectStore(t)
+
+	id, err := s.allocate()
+	if err != nil {
+		t.Fatalf("allocate: %v", err)
+	}
+	s.release(id)
+
+	next, err := s.allocate()
+	if err != nil {
+		t.Fatalf("allocate: %v", err)
+	}
+	if next == id {
+		t.Errorf("allocate reused id %d with no backend wired up; idIsFree should have refused it", id)
+	}
+}
+
+func TestProjectStoreReleaseReusesIdOnceKernelIsClear(t *testing.T) {
+	s := newTestProjectStore(t)
+	backend := &fakeUsageChecker{usage: map[uint32][4]uint64{}}
+	s.backend = backend
+
+	id, err := s.allocate()
+	if err != nil {
+		t.Fatalf("allocate: %v", err)
+	}
+	s.release(id)
+
+	next, err := s.allocate()
+	if err != nil {
+		t.Fatalf("allocate: %v", err)
+	}
+	if next != id {
+		t.Errorf("allocate() = %d, want reused id %d once the kernel reports it idle", next, id)
+	}
+}
+
+func TestProjectStoreReleaseDoesNotReuseWhileQuotaStillLive(t *testing.T) {
+	s := newTestProjectStore(t)
+	backend := &fakeUsageChecker{usage: map[uint32][4]uint64{}}
+	s.backend = backend
+
+	id, err := s.allocate()
+	if err != nil {
+		t.Fatalf("allocate: %v", err)
+	}
+	// Simulate a project whose quota limits were never cleared on removal:
+	// the kernel still reports a nonzero hard limit for this id.
+	backend.usage[id] = [4]uint64{0, 1073741824, 0, 0}
+	s.release(id)
+
+	next, err := s.allocate()
+	if err != nil {
+		t.Fatalf("allocate: %v", err)
+	}
+	if next == id {
+		t.Errorf("allocate reused id %d while the kernel still reports a live quota for it", id)
+	}
+}
@@ -18,38 +18,148 @@ package volume
 
 import (
 	"fmt"
-	"io/ioutil"
 	"os"
 	"os/exec"
 	"path"
 	"regexp"
 	"strconv"
 	"strings"
-	"sync"
+	"time"
 
 	"github.com/docker/docker/pkg/mount"
 	"github.com/golang/glog"
 )
 
 type quotaer interface {
-	AddProject(string, string) (string, uint16, error)
-	RemoveProject(string, uint16) error
-	SetQuota(uint16, string, string) error
-	UnsetQuota() error
+	// AddProject's project id is a uint32: project ids are fsx_projid, a
+	// 32-bit kernel field, so capping allocation at 16 bits would both limit
+	// a node to 65535 live PVs and risk truncating on collision with an
+	// externally-assigned id above that range.
+	AddProject(string, QuotaSpec) (string, uint32, error)
+
+	// RemoveProject deletes projectId's quota record. Unlike AddProject it
+	// does not need the directory or spec back: each project is its own
+	// record in the projects.d store, addressed directly by id. It must clear
+	// projectId's kernel-side limits (via UnsetQuota) before releasing it to
+	// the store's free list: idIsFree only offers a released id back out once
+	// it sees zero usage and zero limits, so one that's never unset here
+	// would fail that check forever and never be reused.
+	RemoveProject(projectId uint32) error
+	SetQuota(uint32, string, QuotaSpec) error
+
+	// UnsetQuota clears projectId's quota limits (but not its project id or
+	// directory association), e.g. by calling SetQuota with an empty
+	// QuotaSpec, so a failed SetQuota can be rolled back and so idIsFree can
+	// eventually see the kernel has forgotten a released id.
+	UnsetQuota(projectId uint32) error
+
+	// GetUsage reports projectId's current usage and hard limits.
+	GetUsage(projectId uint32) (blocksUsed, blocksHard, inodesUsed, inodesHard uint64, err error)
 }
 
-type xfsQuotaer struct {
-	xfsPath string
+// quotaReconciler is implemented by quotaer backends that can cross-check
+// their on-disk project records against kernel-reported quota state, backing
+// the -repair-quotas startup flag.
+type quotaReconciler interface {
+	RepairQuotas() error
+}
+
+// RepairQuotas runs the -repair-quotas fsck pass on q, if its backend
+// supports one: for every project id in the on-disk projects.d store, it
+// cross-checks the kernel-reported quota state (via Q_XGETQUOTA) and
+// re-applies the stored spec where the two diverge. Project ids that the
+// kernel has quota state for but the store has no record of are not looked
+// for.
+func RepairQuotas(q quotaer) error {
+	r, ok := q.(quotaReconciler)
+	if !ok {
+		return fmt.Errorf("quota backend %T does not support -repair-quotas", q)
+	}
+	return r.RepairQuotas()
+}
+
+// QuotaSpec describes the full set of limits a project quota can enforce.
+// Block limits are byte counts, inode limits are file counts, and the grace
+// periods (zero meaning "not set") are how long usage may sit between the
+// soft and hard limit before the kernel starts rejecting writes, mirroring
+// fs_disk_quota's d_blk_softlimit/d_ino_softlimit and FS_DQ_BTIMER/FS_DQ_ITIMER.
+type QuotaSpec struct {
+	BlockHard uint64
+	BlockSoft uint64
+	InodeHard uint64
+	InodeSoft uint64
+
+	BlockGrace time.Duration
+	InodeGrace time.Duration
+}
 
-	// The file where we store mappings between project ids and directories, and
-	// each project's quota limit information, for backup.
-	// Similar to http://man7.org/linux/man-pages/man5/projects.5.html
-	projectsFile string
+// projectLineRe matches one project block in the projects file. The original
+// format was "<projid>:<directory>:<bhard>"; it is extended here with five
+// more numeric fields (bsoft, ihard, isoft, bgrace-seconds, igrace-seconds) to
+// carry the full QuotaSpec. The extra fields are optional so old 3-field
+// blocks written before this change still parse correctly.
+var projectLineRe = regexp.MustCompile(`(?m:\n^([0-9]+):(.+?):([0-9]+)(?::([0-9]+):([0-9]+):([0-9]+):([0-9]+):([0-9]+))?$\n)`)
+
+// parseProjectLine decodes one projectLineRe match into its project id,
+// directory and QuotaSpec.
+func parseProjectLine(match [][]byte) (projectId uint32, directory string, spec QuotaSpec) {
+	id, _ := strconv.ParseUint(string(match[1]), 10, 32)
+	directory = string(match[2])
+
+	spec.BlockHard, _ = strconv.ParseUint(string(match[3]), 10, 64)
+	if len(match[4]) > 0 {
+		spec.BlockSoft, _ = strconv.ParseUint(string(match[4]), 10, 64)
+		spec.InodeHard, _ = strconv.ParseUint(string(match[5]), 10, 64)
+		spec.InodeSoft, _ = strconv.ParseUint(string(match[6]), 10, 64)
+		bgrace, _ := strconv.ParseUint(string(match[7]), 10, 64)
+		igrace, _ := strconv.ParseUint(string(match[8]), 10, 64)
+		spec.BlockGrace = time.Duration(bgrace) * time.Second
+		spec.InodeGrace = time.Duration(igrace) * time.Second
+	}
 
-	projectIds map[uint16]bool
+	return uint32(id), directory, spec
+}
 
-	mapMutex  *sync.Mutex
-	fileMutex *sync.Mutex
+// formatProjectBlock renders a project block in the current (8-field) format.
+func formatProjectBlock(projectId uint32, directory string, spec QuotaSpec) string {
+	return fmt.Sprintf("\n%d:%s:%d:%d:%d:%d:%d:%d\n",
+		projectId, directory,
+		spec.BlockHard, spec.BlockSoft, spec.InodeHard, spec.InodeSoft,
+		int64(spec.BlockGrace.Seconds()), int64(spec.InodeGrace.Seconds()))
+}
+
+// NewQuotaer builds the quotaer selected by the -quota-backend flag:
+//   - "ioctl": drive project quotas directly via FS_IOC_FSGETXATTR/FSSETXATTR
+//     and quotactl, on either XFS or ext4, without shelling out to xfs_quota.
+//     Linux+cgo only.
+//   - "xfs_quota": the original implementation that shells out to the xfs_quota
+//     binary for every call. XFS only.
+//   - "dummy": no quotas are enforced.
+func NewQuotaer(backend, xfsPath string) (quotaer, error) {
+	switch backend {
+	case "ioctl":
+		return newIoctlQuotaer(xfsPath)
+	case "xfs_quota":
+		return newXfsQuotaer(xfsPath)
+	case "dummy":
+		return newDummyQuotaer(), nil
+	default:
+		return nil, fmt.Errorf("unknown quota backend %q, must be one of ioctl, xfs_quota, dummy", backend)
+	}
+}
+
+// SupportedFilesystems backs the -supported-filesystems startup check: it
+// reports which project-quota-capable filesystem (xfs or ext4) backs path, so
+// operators can fail fast instead of discovering an unsupported filesystem the
+// first time a PV is provisioned.
+func SupportedFilesystems(path string) ([]string, error) {
+	return supportedFilesystems(path)
+}
+
+type xfsQuotaer struct {
+	xfsPath string
+
+	store *projectStore
 }
 
 var _ quotaer = &xfsQuotaer{}
@@ -79,33 +189,19 @@ func newXfsQuotaer(xfsPath string) (*xfsQuotaer, error) {
 		return nil, err
 	}
 
-	projectsFile := path.Join(xfsPath, "projects")
-	projectIds := map[uint16]bool{}
-	if _, err := os.Stat(projectsFile); os.IsNotExist(err) {
-		file, err := os.Create(projectsFile)
-		if err != nil {
-			return nil, fmt.Errorf("error creating xfs projects file %s: %v", projectsFile, err)
-		}
-		file.Close()
-	} else {
-		re := regexp.MustCompile("(?m:^([0-9]+):/.+$)")
-		projectIds, err = getExistingIds(projectsFile, re)
-		if err != nil {
-			glog.Errorf("error while populating projectIds map, there may be errors setting quotas later if projectIds are reused: %v", err)
-		}
+	store, err := newProjectStore(xfsPath)
+	if err != nil {
+		return nil, err
 	}
 
 	xfsQuotaer := &xfsQuotaer{
-		xfsPath:      xfsPath,
-		projectsFile: projectsFile,
-		projectIds:   projectIds,
-		mapMutex:     &sync.Mutex{},
-		fileMutex:    &sync.Mutex{},
+		xfsPath: xfsPath,
+		store:   store,
 	}
+	store.backend = xfsQuotaer
 
-	err = xfsQuotaer.restoreQuotas()
-	if err != nil {
-		return nil, fmt.Errorf("error restoring quotas from projects file %s: %v", projectsFile, err)
+	if err := xfsQuotaer.restoreQuotas(); err != nil {
+		return nil, fmt.Errorf("error restoring quotas from projects store %s: %v", store.dir, err)
 	}
 
 	return xfsQuotaer, nil
@@ -137,81 +233,135 @@ func getMountEntry(mountpoint, fstype string) (*mount.Info, error) {
 }
 
 func (q *xfsQuotaer) restoreQuotas() error {
-	read, err := ioutil.ReadFile(q.projectsFile)
+	records, err := q.store.records()
 	if err != nil {
 		return err
 	}
 
-	re := regexp.MustCompile("(?m:\n^([0-9]+):(.+):(.+)$\n)")
-
-	matches := re.FindAllSubmatch(read, -1)
-	for _, match := range matches {
-		projectId, _ := strconv.ParseUint(string(match[1]), 10, 16)
-		directory := string(match[2])
-		bhard := string(match[3])
-
-		// If directory referenced by projects file no longer exists, don't set a
-		// quota for it: will fail
-		if _, err := os.Stat(directory); os.IsNotExist(err) {
-			q.RemoveProject(string(match[0]), uint16(projectId))
+	for _, r := range records {
+		// A directory that no longer exists is garbage-collected here, not in
+		// newProjectStore: RemoveProject needs q (wired up as store.backend by
+		// now) to clear the kernel-side quota before the id is safe to reuse.
+		if _, err := os.Stat(r.Directory); os.IsNotExist(err) {
+			q.RemoveProject(r.ProjectId)
 			continue
 		}
 
-		if err := q.SetQuota(uint16(projectId), directory, bhard); err != nil {
-			return fmt.Errorf("error restoring quota for directory %s: %v", directory, err)
+		if err := q.SetQuota(r.ProjectId, r.Directory, r.Spec); err != nil {
+			return fmt.Errorf("error restoring quota for directory %s: %v", r.Directory, err)
 		}
 	}
 
 	return nil
 }
 
-func (q *xfsQuotaer) AddProject(directory, bhard string) (string, uint16, error) {
-	projectId := generateId(q.mapMutex, q.projectIds)
+func (q *xfsQuotaer) AddProject(directory string, spec QuotaSpec) (string, uint32, error) {
+	projectId, err := q.store.allocate()
+	if err != nil {
+		return "", 0, fmt.Errorf("error allocating a project id: %v", err)
+	}
 	projectIdStr := strconv.FormatUint(uint64(projectId), 10)
 
-	// Store project:directory mapping and also project's quota info
-	block := "\n" + projectIdStr + ":" + directory + ":" + bhard + "\n"
-
-	// Add the project block to the projects file
-	if err := addToFile(q.fileMutex, q.projectsFile, block); err != nil {
-		deleteId(q.mapMutex, q.projectIds, projectId)
-		return "", 0, fmt.Errorf("error adding project block %s to projects file %s: %v", block, q.projectsFile, err)
+	block, err := q.store.add(projectId, directory, spec)
+	if err != nil {
+		q.store.release(projectId)
+		return "", 0, fmt.Errorf("error adding project %d to projects store: %v", projectId, err)
 	}
 
 	// Specify the new project
 	cmd := exec.Command("xfs_quota", "-x", "-c", fmt.Sprintf("project -s -p %s %s", directory, projectIdStr), q.xfsPath)
 	out, err := cmd.CombinedOutput()
 	if err != nil {
-		deleteId(q.mapMutex, q.projectIds, projectId)
-		removeFromFile(q.fileMutex, q.projectsFile, block)
+		q.store.release(projectId)
+		q.store.remove(projectId)
 		return "", 0, fmt.Errorf("xfs_quota failed with error: %v, output: %s", err, out)
 	}
 
+	// Apply the full quota spec now that the project exists; if any part of it
+	// fails, undo whatever limits did land in the kernel and roll back the
+	// project entirely rather than leave a project with no quota (or only a
+	// partial one) in the store.
+	if err := q.SetQuota(projectId, directory, spec); err != nil {
+		if unsetErr := q.UnsetQuota(projectId); unsetErr != nil {
+			glog.Warningf("error rolling back partially-applied quota for project %d: %v", projectId, unsetErr)
+		}
+		q.store.release(projectId)
+		q.store.remove(projectId)
+		return "", 0, fmt.Errorf("error applying quota spec for project %d: %v", projectId, err)
+	}
+
 	return block, projectId, nil
 }
 
-func (q *xfsQuotaer) RemoveProject(block string, projectId uint16) error {
-	deleteId(q.mapMutex, q.projectIds, projectId)
-	return removeFromFile(q.fileMutex, q.projectsFile, block)
+func (q *xfsQuotaer) RemoveProject(projectId uint32) error {
+	// See the RemoveProject doc on the quotaer interface for why this has to
+	// happen before store.release.
+	if err := q.UnsetQuota(projectId); err != nil {
+		glog.Warningf("error clearing quota limits for project %d, it will not be reused until the kernel reports it clear: %v", projectId, err)
+	}
+
+	q.store.release(projectId)
+	return q.store.remove(projectId)
 }
 
-func (q *xfsQuotaer) SetQuota(projectId uint16, directory, bhard string) error {
-	if !q.projectIds[projectId] {
+func (q *xfsQuotaer) SetQuota(projectId uint32, directory string, spec QuotaSpec) error {
+	if !q.store.projectIds[projectId] {
 		return fmt.Errorf("project with id %v has not been added", projectId)
 	}
 	projectIdStr := strconv.FormatUint(uint64(projectId), 10)
 
-	cmd := exec.Command("xfs_quota", "-x", "-c", fmt.Sprintf("limit -p bhard=%s %s", bhard, projectIdStr), q.xfsPath)
+	limit := fmt.Sprintf("limit -p bhard=%d bsoft=%d ihard=%d isoft=%d %s",
+		spec.BlockHard, spec.BlockSoft, spec.InodeHard, spec.InodeSoft, projectIdStr)
+	cmd := exec.Command("xfs_quota", "-x", "-c", limit, q.xfsPath)
 	out, err := cmd.CombinedOutput()
 	if err != nil {
 		return fmt.Errorf("xfs_quota failed with error: %v, output: %s", err, out)
 	}
 
+	if spec.BlockGrace > 0 || spec.InodeGrace > 0 {
+		timer := fmt.Sprintf("timer -p -b %d -i %d %s",
+			int64(spec.BlockGrace.Seconds()), int64(spec.InodeGrace.Seconds()), projectIdStr)
+		cmd := exec.Command("xfs_quota", "-x", "-c", timer, q.xfsPath)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("xfs_quota failed with error: %v, output: %s", err, out)
+		}
+	}
+
 	return nil
 }
 
-func (q *xfsQuotaer) UnsetQuota() error {
-	return nil
+func (q *xfsQuotaer) UnsetQuota(projectId uint32) error {
+	return q.SetQuota(projectId, "", QuotaSpec{})
+}
+
+// xfsQuotaUsageRe parses a line of `xfs_quota -x -c 'quota -p -N -b -i'`
+// output, which prints "<used> <soft> <hard> <grace> <iused> <isoft> <ihard>
+// <igrace>" in 1k-block units for blocks.
+var xfsQuotaUsageRe = regexp.MustCompile(`^\s*(\d+)\s+\d+\s+(\d+)\s+\S+\s+(\d+)\s+\d+\s+(\d+)\s+\S+\s*$`)
+
+func (q *xfsQuotaer) GetUsage(projectId uint32) (blocksUsed, blocksHard, inodesUsed, inodesHard uint64, err error) {
+	if !q.store.projectIds[projectId] {
+		return 0, 0, 0, 0, fmt.Errorf("project with id %v has not been added", projectId)
+	}
+	projectIdStr := strconv.FormatUint(uint64(projectId), 10)
+
+	cmd := exec.Command("xfs_quota", "-x", "-c", fmt.Sprintf("quota -p -N -b -i %s", projectIdStr), q.xfsPath)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return 0, 0, 0, 0, fmt.Errorf("xfs_quota failed with error: %v, output: %s", err, out)
+	}
+
+	match := xfsQuotaUsageRe.FindStringSubmatch(strings.TrimSpace(string(out)))
+	if match == nil {
+		return 0, 0, 0, 0, fmt.Errorf("unexpected xfs_quota report output: %s", out)
+	}
+
+	used, _ := strconv.ParseUint(match[1], 10, 64)
+	hard, _ := strconv.ParseUint(match[2], 10, 64)
+	iused, _ := strconv.ParseUint(match[3], 10, 64)
+	ihard, _ := strconv.ParseUint(match[4], 10, 64)
+
+	return used * 1024, hard * 1024, iused, ihard, nil
 }
 
 type dummyQuotaer struct{}
@@ -222,15 +372,18 @@ func newDummyQuotaer() *dummyQuotaer {
 	return &dummyQuotaer{}
 }
 
-func (q *dummyQuotaer) AddProject(_, _ string) (string, uint16, error) {
+func (q *dummyQuotaer) AddProject(_ string, _ QuotaSpec) (string, uint32, error) {
 	return "", 0, nil
 }
-func (q *dummyQuotaer) RemoveProject(_ string, _ uint16) error {
+func (q *dummyQuotaer) RemoveProject(_ uint32) error {
 	return nil
 }
-func (q *dummyQuotaer) SetQuota(_ uint16, _, _ string) error {
+func (q *dummyQuotaer) SetQuota(_ uint32, _ string, _ QuotaSpec) error {
 	return nil
 }
-func (q *dummyQuotaer) UnsetQuota() error {
+func (q *dummyQuotaer) UnsetQuota(_ uint32) error {
 	return nil
 }
+func (q *dummyQuotaer) GetUsage(_ uint32) (uint64, uint64, uint64, uint64, error) {
+	return 0, 0, 0, 0, nil
+}
@@ -0,0 +1,436 @@
+// +build linux,cgo
+
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+/*
+#include <stdlib.h>
+#include <fcntl.h>
+#include <unistd.h>
+#include <sys/ioctl.h>
+#include <linux/fs.h>
+#include <linux/magic.h>
+#include <linux/quota.h>
+#include <linux/dqblk_xfs.h>
+#include <sys/quota.h>
+#include <sys/statfs.h>
+
+#ifndef EXT4_SUPER_MAGIC
+#define EXT4_SUPER_MAGIC 0xEF53
+#endif
+#ifndef XFS_SUPER_MAGIC
+#define XFS_SUPER_MAGIC 0x58465342
+#endif
+
+#ifndef FS_XFLAG_PROJINHERIT
+#define FS_XFLAG_PROJINHERIT 0x00000200
+struct fsxattr {
+	__u32		fsx_xflags;
+	__u32		fsx_extsize;
+	__u32		fsx_nextents;
+	__u32		fsx_projid;
+	__u32		fsx_cowextsize;
+	unsigned char	fsx_pad[8];
+};
+#define FS_IOC_FSGETXATTR		_IOR('X', 31, struct fsxattr)
+#define FS_IOC_FSSETXATTR		_IOW('X', 32, struct fsxattr)
+#endif
+
+int nfs_quotactl(int cmd, const char *special, int id, void *addr) {
+	return quotactl(cmd, special, id, addr);
+}
+
+// nfs_qcmd wraps the QCMD() macro: cgo cannot call function-like macros
+// directly, only plain functions.
+int nfs_qcmd(int cmd, int type) {
+	return QCMD(cmd, type);
+}
+
+int nfs_fsxattr_get(int fd, struct fsxattr *fsx) {
+	return ioctl(fd, FS_IOC_FSGETXATTR, fsx);
+}
+
+int nfs_fsxattr_set(int fd, struct fsxattr *fsx) {
+	return ioctl(fd, FS_IOC_FSSETXATTR, fsx);
+}
+
+long long nfs_statfs_type(const char *path) {
+	struct statfs buf;
+	if (statfs(path, &buf) != 0) {
+		return -1;
+	}
+	return (long long)buf.f_type;
+}
+*/
+import "C"
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"unsafe"
+
+	"github.com/golang/glog"
+)
+
+// projectFilesystem identifies which on-disk format backs a path's project
+// quotas, since the quotactl command set differs between them.
+type projectFilesystem string
+
+const (
+	xfsFilesystem  projectFilesystem = "xfs"
+	ext4Filesystem projectFilesystem = "ext4"
+)
+
+// projectQuotaer enforces project quotas directly through the filesystem-agnostic
+// FS_IOC_FSGETXATTR/FS_IOC_FSSETXATTR ioctls (available on kernel >= 4.5 for both
+// XFS and ext4) and quotactl. It supports both XFS (mounted with
+// pquota/prjquota) and ext4 (mounted with prjquota).
+type projectQuotaer struct {
+	basePath string
+	fsType   projectFilesystem
+
+	// backingDev is the block device backing basePath, e.g. /dev/sdb1. It is
+	// resolved once at startup and passed as the "special" argument to quotactl.
+	backingDev string
+
+	store *projectStore
+}
+
+var _ quotaer = &projectQuotaer{}
+
+func newIoctlQuotaer(basePath string) (quotaer, error) {
+	if _, err := os.Stat(basePath); os.IsNotExist(err) {
+		return nil, fmt.Errorf("path %s does not exist!", basePath)
+	}
+
+	fsType, err := detectProjectFilesystem(basePath)
+	if err != nil {
+		return nil, fmt.Errorf("error detecting filesystem of path %s: %v", basePath, err)
+	}
+
+	entry, err := getMountEntry(path.Clean(basePath), string(fsType))
+	if err != nil {
+		return nil, err
+	}
+	if !hasProjectQuotaOption(fsType, entry.VfsOpts) {
+		return nil, fmt.Errorf("%s path %s was not mounted with the project quota option", fsType, basePath)
+	}
+
+	backingDev, err := findBackingDev(path.Clean(basePath))
+	if err != nil {
+		return nil, fmt.Errorf("error finding backing device for path %s: %v", basePath, err)
+	}
+
+	store, err := newProjectStore(basePath)
+	if err != nil {
+		return nil, err
+	}
+
+	q := &projectQuotaer{
+		basePath:   basePath,
+		fsType:     fsType,
+		backingDev: backingDev,
+		store:      store,
+	}
+	store.backend = q
+
+	if err := q.restoreQuotas(); err != nil {
+		return nil, fmt.Errorf("error restoring quotas from projects store %s: %v", store.dir, err)
+	}
+
+	return q, nil
+}
+
+// detectProjectFilesystem probes basePath's filesystem via statfs and returns
+// which project-quota-capable filesystem backs it, or an error if it's neither.
+func detectProjectFilesystem(basePath string) (projectFilesystem, error) {
+	cs := C.CString(basePath)
+	defer C.free(unsafe.Pointer(cs))
+
+	magic := C.nfs_statfs_type(cs)
+	if magic < 0 {
+		return "", fmt.Errorf("statfs failed for %s", basePath)
+	}
+
+	return filesystemForStatfsMagic(int64(magic), basePath)
+}
+
+// filesystemForStatfsMagic maps a statfs f_type value to the project-quota-
+// capable filesystem it identifies, or an error if magic is neither XFS's
+// nor ext4's. path is only used to format that error.
+func filesystemForStatfsMagic(magic int64, path string) (projectFilesystem, error) {
+	switch magic {
+	case int64(C.XFS_SUPER_MAGIC):
+		return xfsFilesystem, nil
+	case int64(C.EXT4_SUPER_MAGIC):
+		return ext4Filesystem, nil
+	default:
+		return "", fmt.Errorf("%s is not on a supported filesystem (supported: xfs, ext4)", path)
+	}
+}
+
+// hasProjectQuotaOption reports whether vfsOpts (a mount entry's comma-
+// separated VFS options) enables project quotas for fsType: ext4 only
+// understands "prjquota", XFS accepts either "prjquota" or its older
+// "pquota" alias.
+func hasProjectQuotaOption(fsType projectFilesystem, vfsOpts string) bool {
+	return strings.Contains(vfsOpts, "prjquota") || (fsType == xfsFilesystem && strings.Contains(vfsOpts, "pquota"))
+}
+
+// supportedFilesystems is used to implement the -supported-filesystems startup
+// check: it reports whether basePath sits on a filesystem this backend can
+// enforce project quotas on, without actually constructing a quotaer.
+func supportedFilesystems(basePath string) ([]string, error) {
+	fsType, err := detectProjectFilesystem(basePath)
+	if err != nil {
+		return nil, err
+	}
+	return []string{string(fsType)}, nil
+}
+
+// findBackingDev resolves the block device backing mountpoint by reading
+// /proc/self/mountinfo, the same source docker's projectquota.go uses.
+func findBackingDev(mountpoint string) (string, error) {
+	file, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		// mountinfo fields: ... mount-point ... - fstype source ...
+		for i, field := range fields {
+			if field == "-" && i+2 < len(fields) && len(fields) > 4 && fields[4] == mountpoint {
+				return fields[i+2], nil
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("no mountinfo entry found for mountpoint %s", mountpoint)
+}
+
+func (q *projectQuotaer) restoreQuotas() error {
+	records, err := q.store.records()
+	if err != nil {
+		return err
+	}
+
+	for _, r := range records {
+		if _, err := os.Stat(r.Directory); os.IsNotExist(err) {
+			q.RemoveProject(r.ProjectId)
+			continue
+		}
+
+		if err := q.setProjectId(r.Directory, r.ProjectId); err != nil {
+			return fmt.Errorf("error restoring project id for directory %s: %v", r.Directory, err)
+		}
+		if err := q.SetQuota(r.ProjectId, r.Directory, r.Spec); err != nil {
+			return fmt.Errorf("error restoring quota for directory %s: %v", r.Directory, err)
+		}
+	}
+
+	return nil
+}
+
+func (q *projectQuotaer) AddProject(directory string, spec QuotaSpec) (string, uint32, error) {
+	projectId, err := q.store.allocate()
+	if err != nil {
+		return "", 0, fmt.Errorf("error allocating a project id: %v", err)
+	}
+
+	block, err := q.store.add(projectId, directory, spec)
+	if err != nil {
+		q.store.release(projectId)
+		return "", 0, fmt.Errorf("error adding project %d to projects store: %v", projectId, err)
+	}
+
+	if err := q.setProjectId(directory, projectId); err != nil {
+		q.store.release(projectId)
+		q.store.remove(projectId)
+		return "", 0, fmt.Errorf("error setting project id on directory %s: %v", directory, err)
+	}
+
+	// Apply the full quota spec now that the project id is stamped on
+	// directory; roll back the project id, store entry and any quotactl
+	// state already applied if any field fails to set.
+	if err := q.SetQuota(projectId, directory, spec); err != nil {
+		if unsetErr := q.UnsetQuota(projectId); unsetErr != nil {
+			glog.Warningf("error rolling back partially-applied quota for project %d: %v", projectId, unsetErr)
+		}
+		q.store.release(projectId)
+		q.store.remove(projectId)
+		return "", 0, fmt.Errorf("error applying quota spec for project %d: %v", projectId, err)
+	}
+
+	return block, projectId, nil
+}
+
+func (q *projectQuotaer) RemoveProject(projectId uint32) error {
+	// See the RemoveProject doc on the quotaer interface for why this has to
+	// happen before store.release.
+	if err := q.UnsetQuota(projectId); err != nil {
+		glog.Warningf("error clearing quota limits for project %d, it will not be reused until the kernel reports it clear: %v", projectId, err)
+	}
+
+	q.store.release(projectId)
+	return q.store.remove(projectId)
+}
+
+// setProjectId opens directory, reads its fsxattr via FS_IOC_FSGETXATTR, stamps
+// fsx_projid and ORs in FS_XFLAG_PROJINHERIT so files created under directory
+// inherit the project, then writes it back via FS_IOC_FSSETXATTR.
+func (q *projectQuotaer) setProjectId(directory string, projectId uint32) error {
+	dir, err := os.Open(directory)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	var fsx C.struct_fsxattr
+	if ret, err := C.nfs_fsxattr_get(C.int(dir.Fd()), &fsx); ret < 0 {
+		return fmt.Errorf("failed to get fsxattr for %s: %v", directory, err)
+	}
+
+	fsx.fsx_projid = C.__u32(projectId)
+	fsx.fsx_xflags |= C.FS_XFLAG_PROJINHERIT
+
+	if ret, err := C.nfs_fsxattr_set(C.int(dir.Fd()), &fsx); ret < 0 {
+		return fmt.Errorf("failed to set fsxattr for %s: %v", directory, err)
+	}
+
+	return nil
+}
+
+func (q *projectQuotaer) SetQuota(projectId uint32, directory string, spec QuotaSpec) error {
+	if !q.store.projectIds[projectId] {
+		return fmt.Errorf("project with id %v has not been added", projectId)
+	}
+
+	var d C.struct_fs_disk_quota
+	d.d_version = C.FS_DQUOT_VERSION
+	d.d_id = C.__u32(projectId)
+	d.d_flags = C.FS_PROJ_QUOTA
+	d.d_fieldmask = C.FS_DQ_BHARD | C.FS_DQ_BSOFT | C.FS_DQ_IHARD | C.FS_DQ_ISOFT
+	d.d_blk_hardlimit = C.__u64(bytesToBasicBlocks(spec.BlockHard))
+	d.d_blk_softlimit = C.__u64(bytesToBasicBlocks(spec.BlockSoft))
+	d.d_ino_hardlimit = C.__u64(spec.InodeHard)
+	d.d_ino_softlimit = C.__u64(spec.InodeSoft)
+
+	if spec.BlockGrace > 0 {
+		d.d_fieldmask |= C.FS_DQ_BTIMER
+		d.d_btimer = C.__s32(spec.BlockGrace.Seconds())
+	}
+	if spec.InodeGrace > 0 {
+		d.d_fieldmask |= C.FS_DQ_ITIMER
+		d.d_itimer = C.__s32(spec.InodeGrace.Seconds())
+	}
+
+	cs := C.CString(q.backingDev)
+	defer C.free(unsafe.Pointer(cs))
+
+	if ret, err := C.nfs_quotactl(q.setQuotaCmd(), cs, C.int(projectId), unsafe.Pointer(&d)); ret < 0 {
+		return fmt.Errorf("quotactl set quota limit failed for project %d: %v", projectId, err)
+	}
+
+	return nil
+}
+
+// setQuotaCmd returns the QCMD to set a project quota limit for q.fsType: XFS
+// uses its native project quota type, ext4's generic project quota support
+// uses PRJQUOTA; both go through the same Q_XSETQLIM command.
+func (q *projectQuotaer) setQuotaCmd() C.int {
+	if q.fsType == xfsFilesystem {
+		return C.nfs_qcmd(C.Q_XSETQLIM, C.XQM_PRJQUOTA)
+	}
+	return C.nfs_qcmd(C.Q_XSETQLIM, C.PRJQUOTA)
+}
+
+// getQuotaCmd is the read-side counterpart of setQuotaCmd.
+func (q *projectQuotaer) getQuotaCmd() C.int {
+	if q.fsType == xfsFilesystem {
+		return C.nfs_qcmd(C.Q_XGETQUOTA, C.XQM_PRJQUOTA)
+	}
+	return C.nfs_qcmd(C.Q_XGETQUOTA, C.PRJQUOTA)
+}
+
+func (q *projectQuotaer) UnsetQuota(projectId uint32) error {
+	return q.SetQuota(projectId, "", QuotaSpec{})
+}
+
+// GetUsage reports the current usage and hard limits for projectId via
+// quotactl(Q_XGETQUOTA, ...).
+func (q *projectQuotaer) GetUsage(projectId uint32) (blocksUsed, blocksHard, inodesUsed, inodesHard uint64, err error) {
+	var d C.struct_fs_disk_quota
+
+	cs := C.CString(q.backingDev)
+	defer C.free(unsafe.Pointer(cs))
+
+	if ret, err := C.nfs_quotactl(q.getQuotaCmd(), cs, C.int(projectId), unsafe.Pointer(&d)); ret < 0 {
+		return 0, 0, 0, 0, fmt.Errorf("quotactl get quota failed for project %d: %v", projectId, err)
+	}
+
+	return uint64(d.d_bcount) * 512, uint64(d.d_blk_hardlimit) * 512, uint64(d.d_icount), uint64(d.d_ino_hardlimit), nil
+}
+
+// bytesToBasicBlocks converts a byte count to the 512-byte basic blocks
+// quotactl expects.
+func bytesToBasicBlocks(bytes uint64) uint64 {
+	return (bytes + 511) / 512
+}
+
+var _ quotaReconciler = &projectQuotaer{}
+
+// RepairQuotas implements the -repair-quotas fsck pass for the ioctl backend:
+// for every project the store knows about, sweep its kernel-reported state
+// via GetUsage and re-apply the on-disk spec if the kernel no longer has a
+// quota for that id (e.g. after an unclean backing-device remount lost
+// in-kernel quota state) or reports a different block or inode hard limit than
+// the store does. Soft limits and grace periods are not compared.
+func (q *projectQuotaer) RepairQuotas() error {
+	records, err := q.store.records()
+	if err != nil {
+		return err
+	}
+
+	for _, r := range records {
+		_, kernelHard, _, kernelInodeHard, err := q.GetUsage(r.ProjectId)
+		diverged := err != nil || kernelHard != bytesToBasicBlocks(r.Spec.BlockHard)*512 || kernelInodeHard != r.Spec.InodeHard
+
+		if !diverged {
+			continue
+		}
+
+		glog.Warningf("repair-quotas: project %d (%s) diverged from kernel state, re-applying", r.ProjectId, r.Directory)
+		if err := q.setProjectId(r.Directory, r.ProjectId); err != nil {
+			glog.Errorf("repair-quotas: error re-stamping project id for %s: %v", r.Directory, err)
+			continue
+		}
+		if err := q.SetQuota(r.ProjectId, r.Directory, r.Spec); err != nil {
+			glog.Errorf("repair-quotas: error re-applying quota for project %d: %v", r.ProjectId, err)
+		}
+	}
+
+	return nil
+}
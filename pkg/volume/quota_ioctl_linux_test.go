@@ -0,0 +1,76 @@
+// +build linux,cgo
+
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import "testing"
+
+func TestFilesystemForStatfsMagic(t *testing.T) {
+	tests := []struct {
+		name    string
+		magic   int64
+		want    projectFilesystem
+		wantErr bool
+	}{
+		{name: "xfs", magic: 0x58465342, want: xfsFilesystem},
+		{name: "ext4", magic: 0xEF53, want: ext4Filesystem},
+		{name: "unsupported", magic: 0x9fa0 /* PROC_SUPER_MAGIC */, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := filesystemForStatfsMagic(tt.magic, "/some/path")
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("filesystemForStatfsMagic(%#x) = %q, nil, want an error", tt.magic, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("filesystemForStatfsMagic(%#x) returned error: %v", tt.magic, err)
+			}
+			if got != tt.want {
+				t.Errorf("filesystemForStatfsMagic(%#x) = %q, want %q", tt.magic, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHasProjectQuotaOption(t *testing.T) {
+	tests := []struct {
+		name    string
+		fsType  projectFilesystem
+		vfsOpts string
+		want    bool
+	}{
+		{name: "ext4 with prjquota", fsType: ext4Filesystem, vfsOpts: "rw,relatime,prjquota", want: true},
+		{name: "ext4 without prjquota", fsType: ext4Filesystem, vfsOpts: "rw,relatime", want: false},
+		{name: "ext4 with xfs-only pquota alias is not enough", fsType: ext4Filesystem, vfsOpts: "rw,pquota", want: false},
+		{name: "xfs with prjquota", fsType: xfsFilesystem, vfsOpts: "rw,prjquota", want: true},
+		{name: "xfs with pquota alias", fsType: xfsFilesystem, vfsOpts: "rw,pquota", want: true},
+		{name: "xfs without either", fsType: xfsFilesystem, vfsOpts: "rw,relatime", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := hasProjectQuotaOption(tt.fsType, tt.vfsOpts); got != tt.want {
+				t.Errorf("hasProjectQuotaOption(%q, %q) = %v, want %v", tt.fsType, tt.vfsOpts, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,34 @@
+// +build !linux !cgo
+
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import "fmt"
+
+// newIoctlQuotaer is only implemented on Linux with cgo, where the
+// FS_IOC_FSGETXATTR/FS_IOC_FSSETXATTR and quotactl syscalls it relies on are
+// available.
+func newIoctlQuotaer(xfsPath string) (quotaer, error) {
+	return nil, fmt.Errorf("ioctl quota backend is not supported on this platform, built without linux+cgo")
+}
+
+// supportedFilesystems mirrors newIoctlQuotaer: filesystem detection relies on
+// the same cgo statfs probe, so it is unavailable here too.
+func supportedFilesystems(path string) ([]string, error) {
+	return nil, fmt.Errorf("filesystem detection is not supported on this platform, built without linux+cgo")
+}
@@ -0,0 +1,72 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseProjectLineLegacyThreeField(t *testing.T) {
+	match := projectLineRe.FindSubmatch([]byte("\n1000:/export/pv-1:1073741824\n"))
+	if match == nil {
+		t.Fatalf("projectLineRe did not match a legacy 3-field block")
+	}
+
+	id, directory, spec := parseProjectLine(match)
+	if id != 1000 {
+		t.Errorf("id = %d, want 1000", id)
+	}
+	if directory != "/export/pv-1" {
+		t.Errorf("directory = %q, want /export/pv-1", directory)
+	}
+	if spec.BlockHard != 1073741824 {
+		t.Errorf("BlockHard = %d, want 1073741824", spec.BlockHard)
+	}
+	if spec.BlockSoft != 0 || spec.InodeHard != 0 || spec.InodeSoft != 0 || spec.BlockGrace != 0 || spec.InodeGrace != 0 {
+		t.Errorf("unexpected non-zero fields for a legacy block: %+v", spec)
+	}
+}
+
+func TestFormatProjectBlockParseProjectLineRoundTrip(t *testing.T) {
+	want := QuotaSpec{
+		BlockHard:  1073741824,
+		BlockSoft:  805306368,
+		InodeHard:  100000,
+		InodeSoft:  90000,
+		BlockGrace: 7 * 24 * time.Hour,
+		InodeGrace: 24 * time.Hour,
+	}
+
+	block := formatProjectBlock(1000, "/export/pv-1", want)
+
+	match := projectLineRe.FindSubmatch([]byte(block))
+	if match == nil {
+		t.Fatalf("projectLineRe did not match formatProjectBlock's own output: %q", block)
+	}
+
+	id, directory, got := parseProjectLine(match)
+	if id != 1000 {
+		t.Errorf("id = %d, want 1000", id)
+	}
+	if directory != "/export/pv-1" {
+		t.Errorf("directory = %q, want /export/pv-1", directory)
+	}
+	if got != want {
+		t.Errorf("spec = %+v, want %+v", got, want)
+	}
+}